@@ -1,46 +1,154 @@
 package mpawsalb
 
 import (
-	"errors"
+	"context"
+	"crypto/md5"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"golang.org/x/time/rate"
 )
 
+const (
+	// metricDataQueriesPerRequest is CloudWatch's hard limit on the number of
+	// MetricDataQuery entries accepted by a single GetMetricData call.
+	metricDataQueriesPerRequest = 500
+
+	// defaultRequestsPerSecond is used when Plugin.RequestsPerSecond is unset.
+	defaultRequestsPerSecond = 25.0
+
+	// defaultCacheTTL is used when Plugin.CacheTTL is unset.
+	defaultCacheTTL = time.Hour
+
+	// defaultDelay is used when Plugin.Delay is unset. AWS/ApplicationELB
+	// metrics commonly publish with a few minutes of lag, so querying right
+	// up to "now" tends to find nothing and flap between a real value and
+	// zero.
+	defaultDelay = 5 * time.Minute
+
+	// defaultPeriod is used when Plugin.Period is unset.
+	defaultPeriod = 60 * time.Second
+)
+
+// percentiles is the set of response-time percentiles this plugin reports.
+var percentiles = [...]string{"p99", "p95", "p90", "p50", "p10"}
+
+// dimensionShortName extracts the human-readable name segment from an
+// ARN-suffix dimension value as CloudWatch publishes them, e.g.
+// "app/my-alb/50dc6c495c0c9188" or "targetgroup/my-tg/073e...". This must be
+// used (rather than the raw dimension value) anywhere the name is embedded
+// in a wildcard graph key: go-mackerel-plugin compiles "#" to
+// "[-a-zA-Z0-9_]+", which does not match the "/" in the raw value. Falls
+// back to the raw value if it doesn't look like that format.
+func dimensionShortName(value string) string {
+	parts := strings.Split(value, "/")
+	if len(parts) >= 2 {
+		return parts[1]
+	}
+	return value
+}
+
 // Plugin is ALB plugin for mackerel.
 type Plugin struct {
-	Region          string
-	AccessKeyID     string
-	SecretAccessKey string
-	CloudWatch      *cloudwatch.CloudWatch
-	LBName          string
-	TargetGroups    []string
-	Prefix          string
+	Region               string
+	AccessKeyID          string
+	SecretAccessKey      string
+	Token                string
+	Profile              string
+	SharedCredentialFile string
+	RoleARN              string
+	ExternalID           string
+	CloudWatch           *cloudwatch.CloudWatch
+	LBName               string
+	TargetGroups         []string
+	Prefix               string
+	RequestsPerSecond    float64
+	CacheFile            string
+	CacheTTL             time.Duration
+	RefreshCache         bool
+	ConfigFile           string
+	Profiles             []MetricProfile
+	Delay                time.Duration
+	Period               time.Duration
+}
+
+// targetGroupCache is the on-disk representation of a cached ListMetrics
+// discovery, persisted alongside the plugin's tempfile.
+type targetGroupCache struct {
+	FetchedAt    time.Time `json:"fetched_at"`
+	TargetGroups []string  `json:"target_groups"`
+}
+
+// awsConfig builds the base config for the session, applying static,
+// profile, or shared-credential-file credentials if configured. Role
+// assumption is layered on afterwards in prepare, since it needs a session
+// to call STS through.
+func (p *Plugin) awsConfig() *aws.Config {
+	config := aws.NewConfig()
+	if p.Region != "" {
+		config = config.WithRegion(p.Region)
+	}
+	switch {
+	case p.AccessKeyID != "" && p.SecretAccessKey != "":
+		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, p.Token))
+	case p.Profile != "" || p.SharedCredentialFile != "":
+		config = config.WithCredentials(credentials.NewSharedCredentials(p.SharedCredentialFile, p.Profile))
+	}
+	return config
 }
 
 func (p *Plugin) prepare() error {
-	sess, err := session.NewSession()
+	// SharedConfigEnable also turns on the default chain's web identity
+	// token provider, so a role assumed via AWS_WEB_IDENTITY_TOKEN_FILE
+	// (e.g. an EKS service account) works without any extra flags.
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *p.awsConfig(),
+		SharedConfigState: session.SharedConfigEnable,
+	})
 	if err != nil {
 		return err
 	}
 
-	config := aws.NewConfig()
-	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
+	if p.RoleARN != "" {
+		sess.Config.Credentials = stscreds.NewCredentials(sess, p.RoleARN, func(a *stscreds.AssumeRoleProvider) {
+			if p.ExternalID != "" {
+				a.ExternalID = aws.String(p.ExternalID)
+			}
+		})
 	}
-	if p.Region != "" {
-		config = config.WithRegion(p.Region)
+
+	p.CloudWatch = cloudwatch.New(sess)
+
+	if p.ConfigFile != "" {
+		profiles, err := loadProfiles(p.ConfigFile)
+		if err != nil {
+			return err
+		}
+		p.Profiles = profiles
 	}
 
-	p.CloudWatch = cloudwatch.New(sess, config)
+	if !p.RefreshCache {
+		if ok, err := p.loadTargetGroupsFromCache(); err != nil {
+			return err
+		} else if ok {
+			return nil
+		}
+	}
 
 	dimensions := []*cloudwatch.DimensionFilter{
 		{
@@ -77,133 +185,417 @@ func (p *Plugin) prepare() error {
 		}
 	}
 
-	return nil
+	return p.saveTargetGroupsToCache()
 }
 
-func (p *Plugin) getLastPercentile(stat map[string]float64, prefix string, dimensions []*cloudwatch.Dimension, metricName string) error {
-	now := time.Now()
+// cacheTTL returns the configured cache lifetime, falling back to
+// defaultCacheTTL when unset.
+func (p *Plugin) cacheTTL() time.Duration {
+	if p.CacheTTL > 0 {
+		return p.CacheTTL
+	}
+	return defaultCacheTTL
+}
 
-	response, err := p.CloudWatch.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
-		Dimensions: dimensions,
-		StartTime:  aws.Time(now.Add(-3 * time.Minute)), // 3 min (to fetch at least 1 data-point)
-		EndTime:    aws.Time(now),
-		MetricName: aws.String(metricName),
-		Period:     aws.Int64(60),
-		ExtendedStatistics: []*string{
-			aws.String("p99"), aws.String("p95"), aws.String("p90"), aws.String("p50"), aws.String("p10"),
-		},
-		Namespace: aws.String("AWS/ApplicationELB"),
+// cacheFile returns the path used to persist discovered target groups,
+// deriving a stable default from the plugin's identifying options when
+// CacheFile is unset. The credential-identifying fields are included so two
+// instances pointed at different accounts/roles (the same -region/-lbname,
+// a shared config template, but different -role-arn/-profile) don't collide
+// on one cache file and leak target groups across accounts.
+func (p *Plugin) cacheFile() string {
+	if p.CacheFile != "" {
+		return p.CacheFile
+	}
+	sum := md5.Sum([]byte(strings.Join([]string{
+		p.Region, p.LBName, p.Prefix,
+		p.AccessKeyID, p.RoleARN, p.ExternalID, p.Profile, p.SharedCredentialFile,
+	}, "\x00")))
+	return filepath.Join(os.TempDir(), fmt.Sprintf("mackerel-plugin-aws-alb-targetgroups-%x.json", sum))
+}
+
+// loadTargetGroupsFromCache loads TargetGroups from cacheFile if it exists
+// and is fresher than cacheTTL, reporting whether the cache was used.
+func (p *Plugin) loadTargetGroupsFromCache() (bool, error) {
+	b, err := ioutil.ReadFile(p.cacheFile())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var cache targetGroupCache
+	if err := json.Unmarshal(b, &cache); err != nil {
+		return false, nil
+	}
+	if time.Since(cache.FetchedAt) > p.cacheTTL() {
+		return false, nil
+	}
+
+	p.TargetGroups = cache.TargetGroups
+	return true, nil
+}
+
+// saveTargetGroupsToCache persists the discovered TargetGroups to cacheFile
+// so the next invocation can skip ListMetrics until the cache expires.
+func (p *Plugin) saveTargetGroupsToCache() error {
+	b, err := json.Marshal(targetGroupCache{
+		FetchedAt:    time.Now(),
+		TargetGroups: p.TargetGroups,
 	})
 	if err != nil {
 		return err
 	}
+	return ioutil.WriteFile(p.cacheFile(), b, 0644)
+}
 
-	datapoints := response.Datapoints
-	if len(datapoints) == 0 {
-		return errors.New("fetched no datapoints")
+// requestsPerSecond returns the configured GetMetricData rate, falling back
+// to defaultRequestsPerSecond when unset.
+func (p *Plugin) requestsPerSecond() float64 {
+	if p.RequestsPerSecond > 0 {
+		return p.RequestsPerSecond
 	}
+	return defaultRequestsPerSecond
+}
 
-	for _, percentile := range [...]string{"p99", "p95", "p90", "p50", "p10"} {
-		latest := now
-		var latestVal float64
-		for _, dp := range datapoints {
-			if dp.Timestamp.Before(latest) {
-				continue
-			}
+// delay returns the configured query delay, falling back to defaultDelay
+// when unset.
+func (p *Plugin) delay() time.Duration {
+	if p.Delay > 0 {
+		return p.Delay
+	}
+	return defaultDelay
+}
 
-			latest = *dp.Timestamp
-			latestVal = *dp.ExtendedStatistics[percentile]
-		}
-		stat[prefix+percentile] = latestVal
+// period returns the configured query period, falling back to
+// defaultPeriod when unset.
+func (p *Plugin) period() time.Duration {
+	if p.Period > 0 {
+		return p.Period
 	}
+	return defaultPeriod
+}
 
-	return nil
+// queryWindowPeriod returns the longest period actually in use across the
+// built-in ALB profiles and any -config profiles. The built-in profiles
+// always query at p.period(), but a -config profile may declare its own,
+// longer period; fetchMetricData's query window has to be at least that
+// long, or a GetMetricData call for that profile never contains a single
+// complete bucket and silently returns no datapoints, forever.
+func (p *Plugin) queryWindowPeriod() time.Duration {
+	period := p.period()
+	for _, prof := range p.Profiles {
+		if d := time.Duration(prof.periodSeconds()) * time.Second; d > period {
+			period = d
+		}
+	}
+	return period
 }
 
-// MetricKeyPrefix returns key prefix
-func (p *Plugin) MetricKeyPrefix() string {
-	return p.Prefix
+// percentileMetricKeys is shared as both the MetricKeys and MetricLabels
+// override for the two TargetResponseTime profiles below: the stat-map key
+// and graph label for a percentile are just the percentile name itself
+// (e.g. "p99"), not the generic "targetresponsetime_p99" key or
+// "TargetResponseTime (p99)" label metricKey/metricLabel would otherwise
+// derive.
+func percentileMetricKeys() map[string]string {
+	keys := make(map[string]string, len(percentiles))
+	for _, percentile := range percentiles {
+		keys["TargetResponseTime_"+percentile] = percentile
+	}
+	return keys
 }
 
-// FetchMetrics fetch elb metrics
-func (p *Plugin) FetchMetrics() (map[string]float64, error) {
-	stat := make(map[string]float64)
+// albProfiles expresses this plugin's own AWS/ApplicationELB metric
+// collection as built-in MetricProfile values, so both the -config profiles
+// and ALB's own metrics flow through the same buildQueries/graphDefinition
+// pipeline instead of a second, parallel code path.
+func (p *Plugin) albProfiles() []MetricProfile {
+	period := int64(p.period().Seconds())
+
+	var lbDimensions map[string]string
+	if p.LBName != "" {
+		lbDimensions = map[string]string{"LoadBalancer": p.LBName}
+	}
+
+	targetGroups := make([]metricProfileGroup, len(p.TargetGroups))
+	for i, tg := range p.TargetGroups {
+		targetGroups[i] = metricProfileGroup{DimensionValue: tg, Key: dimensionShortName(tg)}
+	}
+
+	elbGroup := "alb"
+	if p.LBName != "" {
+		elbGroup = dimensionShortName(p.LBName)
+	}
 
-	for _, tg := range p.TargetGroups {
-		glb := []*cloudwatch.Dimension{
-			{
-				Name:  aws.String("TargetGroup"),
-				Value: aws.String(tg),
+	percentileKeys := percentileMetricKeys()
+
+	return []MetricProfile{
+		{
+			Namespace:    "AWS/ApplicationELB",
+			GraphPrefix:  "response_ext",
+			GraphLabel:   "Response Time Percentile",
+			Dimensions:   lbDimensions,
+			MetricNames:  []string{"TargetResponseTime"},
+			Statistics:   percentiles[:],
+			Period:       period,
+			MetricKeys:   percentileKeys,
+			MetricLabels: percentileKeys,
+		},
+		{
+			Namespace:      "AWS/ApplicationELB",
+			GraphPrefix:    "response_ext_per_group",
+			GraphLabel:     "Response Time Percentile per Target Group",
+			Dimensions:     lbDimensions,
+			GroupDimension: "TargetGroup",
+			Groups:         targetGroups,
+			MetricNames:    []string{"TargetResponseTime"},
+			Statistics:     percentiles[:],
+			Period:         period,
+			MetricKeys:     percentileKeys,
+			MetricLabels:   percentileKeys,
+		},
+		{
+			Namespace:    "AWS/ApplicationELB",
+			GraphPrefix:  "requests",
+			GraphLabel:   "Requests",
+			Unit:         mp.UnitInteger,
+			Dimensions:   lbDimensions,
+			MetricNames:  []string{"RequestCount"},
+			Statistics:   []string{"Sum"},
+			Period:       period,
+			MetricKeys:   map[string]string{"RequestCount_Sum": "request_count"},
+			MetricLabels: map[string]string{"RequestCount_Sum": "Requests"},
+		},
+		{
+			Namespace:      "AWS/ApplicationELB",
+			GraphPrefix:    "httpcode_target",
+			GraphLabel:     "HTTP Response Codes (Target)",
+			Unit:           mp.UnitInteger,
+			Dimensions:     lbDimensions,
+			GroupDimension: "TargetGroup",
+			Groups:         targetGroups,
+			MetricNames: []string{
+				"HTTPCode_Target_2XX_Count", "HTTPCode_Target_3XX_Count",
+				"HTTPCode_Target_4XX_Count", "HTTPCode_Target_5XX_Count",
 			},
-		}
-		if p.LBName != "" {
-			g2 := &cloudwatch.Dimension{
-				Name:  aws.String("LoadBalancer"),
-				Value: aws.String(p.LBName),
-			}
-			glb = append(glb, g2)
-		}
-		name := strings.Split(tg, "/")
+			Statistics: []string{"Sum"},
+			Period:     period,
+			MetricKeys: map[string]string{
+				"HTTPCode_Target_2XX_Count_Sum": "2xx",
+				"HTTPCode_Target_3XX_Count_Sum": "3xx",
+				"HTTPCode_Target_4XX_Count_Sum": "4xx",
+				"HTTPCode_Target_5XX_Count_Sum": "5xx",
+			},
+			MetricLabels: map[string]string{
+				"HTTPCode_Target_2XX_Count_Sum": "2XX",
+				"HTTPCode_Target_3XX_Count_Sum": "3XX",
+				"HTTPCode_Target_4XX_Count_Sum": "4XX",
+				"HTTPCode_Target_5XX_Count_Sum": "5XX",
+			},
+		},
+		{
+			Namespace:   "AWS/ApplicationELB",
+			GraphPrefix: "httpcode_elb",
+			GraphLabel:  "HTTP Response Codes (ELB)",
+			Unit:        mp.UnitInteger,
+			Dimensions:  lbDimensions,
+			Groups:      []metricProfileGroup{{Key: elbGroup}},
+			MetricNames: []string{"HTTPCode_ELB_4XX_Count", "HTTPCode_ELB_5XX_Count"},
+			Statistics:  []string{"Sum"},
+			Period:      period,
+			MetricKeys: map[string]string{
+				"HTTPCode_ELB_4XX_Count_Sum": "4xx",
+				"HTTPCode_ELB_5XX_Count_Sum": "5xx",
+			},
+			MetricLabels: map[string]string{
+				"HTTPCode_ELB_4XX_Count_Sum": "4XX",
+				"HTTPCode_ELB_5XX_Count_Sum": "5XX",
+			},
+		},
+		{
+			Namespace:   "AWS/ApplicationELB",
+			GraphPrefix: "connections",
+			GraphLabel:  "Connections",
+			Unit:        mp.UnitInteger,
+			Dimensions:  lbDimensions,
+			MetricNames: []string{
+				"ActiveConnectionCount", "NewConnectionCount",
+				"RejectedConnectionCount", "TargetConnectionErrorCount",
+			},
+			Statistics: []string{"Sum"},
+			Period:     period,
+			MetricKeys: map[string]string{
+				"ActiveConnectionCount_Sum":      "active_connection_count",
+				"NewConnectionCount_Sum":         "new_connection_count",
+				"RejectedConnectionCount_Sum":    "rejected_connection_count",
+				"TargetConnectionErrorCount_Sum": "target_connection_error_count",
+			},
+			MetricLabels: map[string]string{
+				"ActiveConnectionCount_Sum":      "Active Connections",
+				"NewConnectionCount_Sum":         "New Connections",
+				"RejectedConnectionCount_Sum":    "Rejected Connections",
+				"TargetConnectionErrorCount_Sum": "Target Connection Errors",
+			},
+		},
+		{
+			Namespace:      "AWS/ApplicationELB",
+			GraphPrefix:    "hosts",
+			GraphLabel:     "Hosts per Target Group",
+			Unit:           mp.UnitInteger,
+			Dimensions:     lbDimensions,
+			GroupDimension: "TargetGroup",
+			Groups:         targetGroups,
+			MetricNames:    []string{"HealthyHostCount", "UnHealthyHostCount"},
+			Statistics:     []string{"Average"},
+			Period:         period,
+			MetricKeys: map[string]string{
+				"HealthyHostCount_Average":   "healthy_host_count",
+				"UnHealthyHostCount_Average": "unhealthy_host_count",
+			},
+			MetricLabels: map[string]string{
+				"HealthyHostCount_Average":   "Healthy Hosts",
+				"UnHealthyHostCount_Average": "Unhealthy Hosts",
+			},
+		},
+		{
+			Namespace:    "AWS/ApplicationELB",
+			GraphPrefix:  "bytes",
+			GraphLabel:   "Processed Bytes",
+			Unit:         mp.UnitBytes,
+			Dimensions:   lbDimensions,
+			MetricNames:  []string{"ProcessedBytes"},
+			Statistics:   []string{"Sum"},
+			Period:       period,
+			MetricKeys:   map[string]string{"ProcessedBytes_Sum": "processed_bytes"},
+			MetricLabels: map[string]string{"ProcessedBytes_Sum": "Processed Bytes"},
+		},
+	}
+}
 
-		if err := p.getLastPercentile(stat, "response_ext_per_group."+name[1]+".", glb, "TargetResponseTime"); err != nil {
-			return nil, err
+// buildMetricDataQueries builds one MetricDataQuery per metric declared by
+// the built-in ALB profiles and any -config profiles, and returns the
+// stat-map key each query id corresponds to.
+func (p *Plugin) buildMetricDataQueries() ([]*cloudwatch.MetricDataQuery, map[string]string) {
+	var queries []*cloudwatch.MetricDataQuery
+	keys := make(map[string]string)
+
+	counter := 0
+	nextID := func() string {
+		id := fmt.Sprintf("q%d", counter)
+		counter++
+		return id
+	}
+
+	for _, prof := range append(p.albProfiles(), p.Profiles...) {
+		profQueries, profKeys := prof.buildQueries(nextID)
+		queries = append(queries, profQueries...)
+		for id, key := range profKeys {
+			keys[id] = key
 		}
 	}
 
-	glb := []*cloudwatch.Dimension{}
-	if p.LBName != "" {
-		g2 := &cloudwatch.Dimension{
-			Name:  aws.String("LoadBalancer"),
-			Value: aws.String(p.LBName),
+	return queries, keys
+}
+
+// fetchMetricData submits queries to GetMetricData, chunked at
+// metricDataQueriesPerRequest and rate-limited to p.requestsPerSecond(),
+// and maps the results back to stat-map keys using keys.
+func (p *Plugin) fetchMetricData(queries []*cloudwatch.MetricDataQuery, keys map[string]string) (map[string]float64, error) {
+	// The query window is [now-delay-period, now-delay], aligned to period
+	// boundaries, rather than ending at "now": AWS/ApplicationELB metrics
+	// commonly publish a few minutes late, so a window that runs right up
+	// to "now" frequently finds no datapoint yet and flaps between a real
+	// value and zero once the late point arrives. period is the longest
+	// period in use across every query in this batch, so a -config profile
+	// with a longer period than the default still gets a window wide enough
+	// to contain a complete bucket.
+	period := p.queryWindowPeriod()
+	end := time.Now().Add(-p.delay()).Truncate(period)
+	start := end.Add(-period)
+
+	var chunks [][]*cloudwatch.MetricDataQuery
+	for len(queries) > 0 {
+		n := metricDataQueriesPerRequest
+		if n > len(queries) {
+			n = len(queries)
 		}
-		glb = append(glb, g2)
+		chunks = append(chunks, queries[:n])
+		queries = queries[n:]
 	}
 
-	if err := p.getLastPercentile(stat, "", glb, "TargetResponseTime"); err != nil {
-		return nil, err
+	limiter := rate.NewLimiter(rate.Limit(p.requestsPerSecond()), 1)
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		stat = make(map[string]float64, len(keys))
+		errs = make([]error, len(chunks))
+	)
+
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk []*cloudwatch.MetricDataQuery) {
+			defer wg.Done()
+
+			if err := limiter.Wait(context.Background()); err != nil {
+				errs[i] = err
+				return
+			}
+
+			resp, err := p.CloudWatch.GetMetricData(&cloudwatch.GetMetricDataInput{
+				StartTime:         aws.Time(start),
+				EndTime:           aws.Time(end),
+				MetricDataQueries: chunk,
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, result := range resp.MetricDataResults {
+				if result.Id == nil || len(result.Values) == 0 {
+					continue
+				}
+				key, ok := keys[*result.Id]
+				if !ok {
+					continue
+				}
+				stat[key] = *result.Values[0]
+			}
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return stat, nil
 }
 
+// MetricKeyPrefix returns key prefix
+func (p *Plugin) MetricKeyPrefix() string {
+	return p.Prefix
+}
+
+// FetchMetrics fetch elb metrics
+func (p *Plugin) FetchMetrics() (map[string]float64, error) {
+	queries, keys := p.buildMetricDataQueries()
+	return p.fetchMetricData(queries, keys)
+}
+
 // GraphDefinition for Mackerel
 func (p *Plugin) GraphDefinition() map[string]mp.Graphs {
-	/*met := make([]mp.Metrics, 0, 5*len(p.TargetGroups))
-	for _, tg := range p.TargetGroups {
-		name := strings.Split(tg, "/")
-		for _, percentile := range [...]string{"p99", "p95", "p90", "p50", "p10"} {
-			met = append(met, mp.Metrics{
-				Name:  name[1] + "_" + percentile,
-				Label: percentile,
-			})
-		}
-	}*/
-
-	graphdef := map[string]mp.Graphs{
-		"response_ext": {
-			Label: "Response Time Percentile",
-			Unit:  mp.UnitFloat,
-			Metrics: []mp.Metrics{
-				{Name: "p99", Label: "p99"},
-				{Name: "p95", Label: "p95"},
-				{Name: "p90", Label: "p90"},
-				{Name: "p50", Label: "p50"},
-				{Name: "p10", Label: "p10"},
-			},
-		},
-		"response_ext_per_group.#": {
-			Label: "Response Time Percentile per Target Group",
-			Unit:  mp.UnitFloat,
-			Metrics: []mp.Metrics{
-				{Name: "p99", Label: "p99"},
-				{Name: "p95", Label: "p95"},
-				{Name: "p90", Label: "p90"},
-				{Name: "p50", Label: "p50"},
-				{Name: "p10", Label: "p10"},
-			},
-		},
+	graphdef := make(map[string]mp.Graphs)
+	for _, prof := range append(p.albProfiles(), p.Profiles...) {
+		graphdef[prof.graphKey()] = prof.graphDefinition()
 	}
-
 	return graphdef
 }
 
@@ -213,8 +605,20 @@ func Do() {
 	optLBName := flag.String("lbname", "", "ELB Name")
 	optAccessKeyID := flag.String("access-key-id", "", "AWS Access Key ID")
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
+	optToken := flag.String("token", "", "AWS Session Token")
+	optProfile := flag.String("profile", "", "AWS shared config/credentials profile to use")
+	optSharedCredentialFile := flag.String("shared-credential-file", "", "Path to an AWS shared credentials file")
+	optRoleARN := flag.String("role-arn", "", "ARN of an IAM role to assume before calling CloudWatch")
+	optExternalID := flag.String("external-id", "", "External ID to use when assuming -role-arn")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	optPrefix := flag.String("metric-key-prefix", "alb", "Metric key prefix")
+	optRequestsPerSecond := flag.Float64("cloudwatch-rps", defaultRequestsPerSecond, "Max GetMetricData requests per second")
+	optCacheFile := flag.String("cache-file", "", "Path to the target group cache file (default: derived from region/lbname/credentials)")
+	optCacheTTL := flag.Duration("cache-ttl", defaultCacheTTL, "TTL for the cached target group list")
+	optRefreshCache := flag.Bool("refresh-cache", false, "Ignore the cached target group list and re-run ListMetrics")
+	optConfigFile := flag.String("config", "", "Path to a TOML or YAML file of extra CloudWatch metric profiles (NLB, CLB, custom namespaces, ...)")
+	optDelay := flag.Duration("delay", defaultDelay, "How far behind \"now\" to query, to allow for CloudWatch metric publication lag")
+	optPeriod := flag.Duration("period", defaultPeriod, "CloudWatch metric period")
 	flag.Parse()
 
 	var alb Plugin
@@ -229,8 +633,20 @@ func Do() {
 	}
 	alb.AccessKeyID = *optAccessKeyID
 	alb.SecretAccessKey = *optSecretAccessKey
+	alb.Token = *optToken
+	alb.Profile = *optProfile
+	alb.SharedCredentialFile = *optSharedCredentialFile
+	alb.RoleARN = *optRoleARN
+	alb.ExternalID = *optExternalID
 	alb.LBName = *optLBName
 	alb.Prefix = *optPrefix
+	alb.RequestsPerSecond = *optRequestsPerSecond
+	alb.ConfigFile = *optConfigFile
+	alb.Delay = *optDelay
+	alb.Period = *optPeriod
+	alb.CacheFile = *optCacheFile
+	alb.CacheTTL = *optCacheTTL
+	alb.RefreshCache = *optRefreshCache
 
 	err := alb.prepare()
 	if err != nil {
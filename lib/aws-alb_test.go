@@ -0,0 +1,155 @@
+package mpawsalb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// graphKeyPattern turns a GraphDefinition key such as "httpcode_target.#"
+// into the same "#" -> "[-a-zA-Z0-9_]+" regex go-mackerel-plugin compiles it
+// to, anchored around the metric name that follows it.
+func graphKeyPattern(graphKey, metricName string) *regexp.Regexp {
+	escaped := regexp.QuoteMeta(graphKey)
+	wildcard := strings.ReplaceAll(escaped, regexp.QuoteMeta("#"), "[-a-zA-Z0-9_]+")
+	return regexp.MustCompile("^" + wildcard + "\\." + regexp.QuoteMeta(metricName) + "$")
+}
+
+// assertMetricIsReachable fails unless some key produced by
+// buildMetricDataQueries would actually be looked up by go-mackerel-plugin
+// for the given graph/metric: a bare match on metric.Name for non-wildcard
+// graphs, or a "<graph-with-#-as-wildcard>.<metric.Name>" match for
+// wildcard ones.
+func assertMetricIsReachable(t *testing.T, graphKey string, metricName string, keys map[string]string) {
+	t.Helper()
+
+	if !strings.Contains(graphKey, "#") {
+		for _, key := range keys {
+			if key == metricName {
+				return
+			}
+		}
+		t.Fatalf("graph %q metric %q: no produced stat key equals the bare metric name (got keys %v)", graphKey, metricName, keys)
+	}
+
+	pattern := graphKeyPattern(graphKey, metricName)
+	for _, key := range keys {
+		if pattern.MatchString(key) {
+			return
+		}
+	}
+	t.Fatalf("graph %q metric %q: no produced stat key matches %s (got keys %v)", graphKey, metricName, pattern, keys)
+}
+
+func TestTargetGroupCacheRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-aws-alb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cacheFile := filepath.Join(dir, "cache.json")
+	want := []string{"targetgroup/a/1", "targetgroup/b/2"}
+
+	p := &Plugin{CacheFile: cacheFile, TargetGroups: want}
+	if err := p.saveTargetGroupsToCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &Plugin{CacheFile: cacheFile}
+	ok, err := loaded.loadTargetGroupsFromCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected a fresh cache to be used")
+	}
+	if len(loaded.TargetGroups) != len(want) {
+		t.Fatalf("got %v, want %v", loaded.TargetGroups, want)
+	}
+	for i, tg := range want {
+		if loaded.TargetGroups[i] != tg {
+			t.Fatalf("got %v, want %v", loaded.TargetGroups, want)
+		}
+	}
+}
+
+func TestTargetGroupCacheExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-aws-alb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cacheFile := filepath.Join(dir, "cache.json")
+
+	p := &Plugin{CacheFile: cacheFile, CacheTTL: time.Minute, TargetGroups: []string{"targetgroup/a/1"}}
+	if err := p.saveTargetGroupsToCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backdate the cache past its TTL.
+	stale := &Plugin{CacheFile: cacheFile, CacheTTL: time.Minute}
+	if err := ioutil.WriteFile(cacheFile, []byte(`{"fetched_at":"2000-01-01T00:00:00Z","target_groups":["targetgroup/a/1"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := stale.loadTargetGroupsFromCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected an expired cache to be ignored")
+	}
+}
+
+func TestCacheFileSeparatesCredentialIdentity(t *testing.T) {
+	base := &Plugin{Region: "us-east-1", LBName: "app/my-alb/abc"}
+	withRole := &Plugin{Region: "us-east-1", LBName: "app/my-alb/abc", RoleARN: "arn:aws:iam::111111111111:role/other"}
+
+	if base.cacheFile() == withRole.cacheFile() {
+		t.Fatal("expected different -role-arn values to use different default cache files")
+	}
+}
+
+func TestCacheFileHonorsExplicitOverride(t *testing.T) {
+	p := &Plugin{CacheFile: "/tmp/explicit-cache.json"}
+	if got := p.cacheFile(); got != "/tmp/explicit-cache.json" {
+		t.Fatalf("got %q, want explicit CacheFile", got)
+	}
+}
+
+// TestBuiltinMetricsReachGraphDefinition end-to-end checks that every
+// metric buildMetricDataQueries produces a stat key for is actually
+// reachable through the matching GraphDefinition entry, the way
+// go-mackerel-plugin's OutputValues looks it up. It would have caught the
+// "requests.request_count" vs "request_count" key/metric-name mismatch, and
+// the ARN-slash in a "#" wildcard segment, immediately.
+func TestBuiltinMetricsReachGraphDefinition(t *testing.T) {
+	p := &Plugin{
+		LBName: "app/my-alb/50dc6c495c0c9188",
+		TargetGroups: []string{
+			"targetgroup/my-tg-a/073e1example1",
+			"targetgroup/my-tg-b/073e1example2",
+		},
+	}
+
+	_, keys := p.buildMetricDataQueries()
+	graphdef := p.GraphDefinition()
+
+	for graphKey, graph := range graphdef {
+		for _, metric := range graph.Metrics {
+			assertMetricIsReachable(t, graphKey, metric.Name, keys)
+		}
+	}
+
+	for _, key := range keys {
+		if strings.Contains(key, "/") {
+			t.Fatalf("stat key %q contains a raw dimension value with \"/\"; it won't match any \"#\" wildcard graph", key)
+		}
+	}
+}
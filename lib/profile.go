@@ -0,0 +1,243 @@
+package mpawsalb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	mp "github.com/mackerelio/go-mackerel-plugin"
+	"gopkg.in/yaml.v2"
+)
+
+// metricProfileGroup names one value a MetricProfile is collected per, e.g.
+// one target group. DimensionValue is the raw CloudWatch dimension value to
+// query; Key is the (slash-free) segment used in the published stat key and
+// "#" wildcard graph name, which may differ from DimensionValue since AWS
+// dimension values are ARN suffixes like "targetgroup/name/id".
+type metricProfileGroup struct {
+	DimensionValue string
+	Key            string
+}
+
+// MetricProfile describes one CloudWatch namespace/graph to scrape: which
+// metrics, dimensions, and statistics to query, and what graph key to
+// publish them under. The built-in AWS/ApplicationELB behavior is itself
+// expressed as a handful of these (see albProfiles in aws-alb.go), and
+// -config lets operators layer on NLB (AWS/NetworkELB), CLB (AWS/ELB), or
+// any other namespace using the same query/cache/rate-limit machinery
+// instead of forking a new plugin per AWS service.
+//
+// A profile with neither Groups nor a GroupDimension publishes one flat,
+// non-wildcard graph. A profile with either publishes one "foo.#"-style
+// graph with one instance per group, the same way go-mackerel-plugin's own
+// per-device/per-process graphs work; with a GroupDimension but no Groups it
+// builds no queries, so that graph has no instances.
+type MetricProfile struct {
+	Namespace   string            `toml:"namespace" yaml:"namespace"`
+	GraphPrefix string            `toml:"graph_prefix" yaml:"graph_prefix"`
+	GraphLabel  string            `toml:"graph_label" yaml:"graph_label"`
+	Unit        string            `toml:"unit" yaml:"unit"`
+	MetricNames []string          `toml:"metric_names" yaml:"metric_names"`
+	Dimensions  map[string]string `toml:"dimensions" yaml:"dimensions"`
+	Statistics  []string          `toml:"statistics" yaml:"statistics"`
+	Period      int64             `toml:"period" yaml:"period"`
+
+	// GroupDimension, Groups, MetricKeys and MetricLabels are set by
+	// built-in profiles only; they have no TOML/YAML tag because a
+	// user-supplied profile is always a single flat set of dimensions.
+	GroupDimension string
+	Groups         []metricProfileGroup
+	MetricKeys     map[string]string
+	MetricLabels   map[string]string
+}
+
+// loadProfiles reads MetricProfile entries from a TOML or YAML file,
+// selected by the file extension (.yaml/.yml for YAML, anything else for
+// TOML, matching go-mackerel-plugin's own config conventions).
+func loadProfiles(path string) ([]MetricProfile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Profiles []MetricProfile `toml:"profile" yaml:"profile"`
+	}
+
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &config); err != nil {
+			return nil, err
+		}
+	default:
+		if _, err := toml.Decode(string(b), &config); err != nil {
+			return nil, err
+		}
+	}
+
+	// An unset Period defaults to 60 in periodSeconds(); no need to fill it
+	// in here too.
+	return config.Profiles, nil
+}
+
+// dimensions converts the profile's name/value map into the sorted
+// []*cloudwatch.Dimension GetMetricData expects.
+func (prof MetricProfile) dimensions() []*cloudwatch.Dimension {
+	names := make([]string, 0, len(prof.Dimensions))
+	for name := range prof.Dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dimensions := make([]*cloudwatch.Dimension, 0, len(names))
+	for _, name := range names {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(prof.Dimensions[name]),
+		})
+	}
+	return dimensions
+}
+
+// metricKey returns the stat-map key and GraphDefinition metric name a given
+// metric/statistic pair is published under, honoring MetricKeys overrides
+// used by the built-in profiles (e.g. "HTTPCode_Target_2XX_Count"+"Sum" ->
+// "2xx") and falling back to a generic "metricname_stat" for everything
+// else.
+func (prof MetricProfile) metricKey(metricName, stat string) string {
+	if key, ok := prof.MetricKeys[metricName+"_"+stat]; ok {
+		return key
+	}
+	return strings.ToLower(metricName) + "_" + strings.ToLower(stat)
+}
+
+// metricLabel returns the GraphDefinition label for a metric/statistic
+// pair, honoring MetricLabels overrides used by the built-in profiles and
+// falling back to a generic "MetricName (Stat)" otherwise.
+func (prof MetricProfile) metricLabel(metricName, stat string) string {
+	if label, ok := prof.MetricLabels[metricName+"_"+stat]; ok {
+		return label
+	}
+	return fmt.Sprintf("%s (%s)", metricName, stat)
+}
+
+// periodSeconds returns the configured query period in seconds, defaulting
+// to 60 when unset. Built-in profiles set this from Plugin.period(); a
+// -config profile may set its own, different period.
+func (prof MetricProfile) periodSeconds() int64 {
+	if prof.Period > 0 {
+		return prof.Period
+	}
+	return 60
+}
+
+// buildQueries builds one MetricDataQuery per (group x metric name x
+// statistic) declared in prof - or just (metric name x statistic) for a
+// flat, groupless profile - and returns the stat-map key each query id
+// corresponds to. go-mackerel-plugin's wildcard matcher anchors on the full
+// literal graph key with "#" replaced by the group, so a grouped key is
+// "<GraphPrefix>.<group.Key>.<metricKey>", not just "<group.Key>.<metricKey>";
+// a flat key is the bare metricKey, matching go-mackerel-plugin's bare-name
+// lookup for a non-wildcard graph.
+func (prof MetricProfile) buildQueries(nextID func() string) ([]*cloudwatch.MetricDataQuery, map[string]string) {
+	grouped := prof.GroupDimension != "" || len(prof.Groups) > 0
+
+	groups := prof.Groups
+	if len(groups) == 0 {
+		if prof.GroupDimension != "" {
+			// A grouped profile with no groups (e.g. no target groups
+			// discovered yet) publishes nothing rather than one bogus
+			// ungrouped query.
+			return nil, map[string]string{}
+		}
+		groups = []metricProfileGroup{{}}
+	}
+
+	var queries []*cloudwatch.MetricDataQuery
+	keys := make(map[string]string)
+
+	for _, group := range groups {
+		dimensions := prof.dimensions()
+		if prof.GroupDimension != "" && group.DimensionValue != "" {
+			dimensions = append(append([]*cloudwatch.Dimension{}, dimensions...), &cloudwatch.Dimension{
+				Name:  aws.String(prof.GroupDimension),
+				Value: aws.String(group.DimensionValue),
+			})
+		}
+
+		keyPrefix := ""
+		if grouped {
+			keyPrefix = prof.GraphPrefix + "."
+			if group.Key != "" {
+				keyPrefix += group.Key + "."
+			}
+		}
+
+		for _, metricName := range prof.MetricNames {
+			for _, stat := range prof.Statistics {
+				id := nextID()
+				queries = append(queries, &cloudwatch.MetricDataQuery{
+					Id: aws.String(id),
+					MetricStat: &cloudwatch.MetricStat{
+						Metric: &cloudwatch.Metric{
+							Namespace:  aws.String(prof.Namespace),
+							MetricName: aws.String(metricName),
+							Dimensions: dimensions,
+						},
+						Period: aws.Int64(prof.periodSeconds()),
+						Stat:   aws.String(stat),
+					},
+					ReturnData: aws.Bool(true),
+				})
+				keys[id] = keyPrefix + prof.metricKey(metricName, stat)
+			}
+		}
+	}
+
+	return queries, keys
+}
+
+// graphKey returns the GraphDefinition map key for prof: GraphPrefix itself
+// for a flat profile, or "<GraphPrefix>.#" for a grouped one.
+func (prof MetricProfile) graphKey() string {
+	if len(prof.Groups) == 0 && prof.GroupDimension == "" {
+		return prof.GraphPrefix
+	}
+	return prof.GraphPrefix + ".#"
+}
+
+// graphDefinition builds the GraphDefinition entry for prof, with one
+// metric per (metric name x statistic) it declares. The same metric set is
+// shared by every group instance, matching the existing convention for
+// per-target-group graphs.
+func (prof MetricProfile) graphDefinition() mp.Graphs {
+	metrics := make([]mp.Metrics, 0, len(prof.MetricNames)*len(prof.Statistics))
+	for _, metricName := range prof.MetricNames {
+		for _, stat := range prof.Statistics {
+			metrics = append(metrics, mp.Metrics{
+				Name:  prof.metricKey(metricName, stat),
+				Label: prof.metricLabel(metricName, stat),
+			})
+		}
+	}
+
+	label := prof.GraphLabel
+	if label == "" {
+		label = prof.Namespace
+	}
+	unit := prof.Unit
+	if unit == "" {
+		unit = mp.UnitFloat
+	}
+
+	return mp.Graphs{
+		Label:   label,
+		Unit:    unit,
+		Metrics: metrics,
+	}
+}
@@ -0,0 +1,273 @@
+package mpawsalb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTempConfig writes contents to a file named name inside a fresh temp
+// dir and returns its path; the extension on name selects TOML vs YAML
+// decoding in loadProfiles.
+func writeTempConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "mackerel-plugin-aws-alb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// assertLoadedNLBProfile checks the one profile both
+// TestLoadProfilesFromTOML and TestLoadProfilesFromYAML decode, covering a
+// nested dimensions map, a multi-entry metric_names list, and an
+// explicit period - the documented config shape for -config.
+func assertLoadedNLBProfile(t *testing.T, profiles []MetricProfile) {
+	t.Helper()
+
+	if len(profiles) != 1 {
+		t.Fatalf("got %d profiles, want 1: %+v", len(profiles), profiles)
+	}
+	prof := profiles[0]
+
+	if prof.Namespace != "AWS/NetworkELB" {
+		t.Errorf("got Namespace %q, want \"AWS/NetworkELB\"", prof.Namespace)
+	}
+	if prof.GraphPrefix != "nlb_flows" {
+		t.Errorf("got GraphPrefix %q, want \"nlb_flows\"", prof.GraphPrefix)
+	}
+	if len(prof.MetricNames) != 2 || prof.MetricNames[0] != "ActiveFlowCount" || prof.MetricNames[1] != "NewFlowCount" {
+		t.Errorf("got MetricNames %v, want [ActiveFlowCount NewFlowCount]", prof.MetricNames)
+	}
+	if len(prof.Statistics) != 1 || prof.Statistics[0] != "Sum" {
+		t.Errorf("got Statistics %v, want [Sum]", prof.Statistics)
+	}
+	if want := map[string]string{"LoadBalancer": "net/my-nlb/50dc6c495c0c9188"}; prof.Dimensions["LoadBalancer"] != want["LoadBalancer"] {
+		t.Errorf("got Dimensions %v, want %v", prof.Dimensions, want)
+	}
+	if prof.Period != 300 {
+		t.Errorf("got Period %d, want 300", prof.Period)
+	}
+
+	// buildQueries/graphDefinition should still work end-to-end against a
+	// profile decoded from a file, not just one built as a Go literal.
+	_, keys := prof.buildQueries(func() string { return "q0" })
+	graph := prof.graphDefinition()
+	for _, key := range keys {
+		found := false
+		for _, metric := range graph.Metrics {
+			if metric.Name == key {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("stat key %q has no matching bare Metrics.Name in %v", key, graph.Metrics)
+		}
+	}
+}
+
+func TestLoadProfilesFromTOML(t *testing.T) {
+	path := writeTempConfig(t, "profiles.toml", `
+[[profile]]
+namespace = "AWS/NetworkELB"
+graph_prefix = "nlb_flows"
+metric_names = ["ActiveFlowCount", "NewFlowCount"]
+statistics = ["Sum"]
+period = 300
+
+[profile.dimensions]
+LoadBalancer = "net/my-nlb/50dc6c495c0c9188"
+`)
+
+	profiles, err := loadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLoadedNLBProfile(t, profiles)
+}
+
+func TestLoadProfilesFromYAML(t *testing.T) {
+	path := writeTempConfig(t, "profiles.yaml", `
+profile:
+  - namespace: AWS/NetworkELB
+    graph_prefix: nlb_flows
+    metric_names:
+      - ActiveFlowCount
+      - NewFlowCount
+    statistics:
+      - Sum
+    period: 300
+    dimensions:
+      LoadBalancer: net/my-nlb/50dc6c495c0c9188
+`)
+
+	profiles, err := loadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLoadedNLBProfile(t, profiles)
+}
+
+// TestLoadProfilesPeriodDefaultsAtQueryTime checks that a profile with no
+// period in its config file ends up using periodSeconds()'s 60s default at
+// query-build time, not some other value silently introduced while decoding.
+func TestLoadProfilesPeriodDefaultsAtQueryTime(t *testing.T) {
+	path := writeTempConfig(t, "profiles.toml", `
+[[profile]]
+namespace = "AWS/NetworkELB"
+graph_prefix = "nlb_flows"
+metric_names = ["ActiveFlowCount"]
+statistics = ["Sum"]
+`)
+
+	profiles, err := loadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 1 {
+		t.Fatalf("got %d profiles, want 1", len(profiles))
+	}
+	if profiles[0].Period != 0 {
+		t.Fatalf("got Period %d, want 0 (unset in file)", profiles[0].Period)
+	}
+	if got := profiles[0].periodSeconds(); got != 60 {
+		t.Fatalf("got periodSeconds() %d, want 60", got)
+	}
+}
+
+// TestMetricProfileFlatBuildQueriesMatchesGraphDefinition checks a flat
+// (non-wildcard) profile end-to-end: every key buildQueries produces for a
+// fake stat map is reachable through graphDefinition()'s bare Metrics.Name,
+// the same bare-name lookup go-mackerel-plugin's OutputValues performs for a
+// non-wildcard graph.
+func TestMetricProfileFlatBuildQueriesMatchesGraphDefinition(t *testing.T) {
+	prof := MetricProfile{
+		Namespace:   "AWS/NetworkELB",
+		GraphPrefix: "nlb_requests",
+		MetricNames: []string{"ActiveFlowCount"},
+		Statistics:  []string{"Sum"},
+		Period:      60,
+	}
+
+	counter := 0
+	nextID := func() string {
+		counter++
+		return "q" + string(rune('0'+counter))
+	}
+
+	_, keys := prof.buildQueries(nextID)
+	if len(keys) != 1 {
+		t.Fatalf("got %d keys, want 1: %v", len(keys), keys)
+	}
+
+	graph := prof.graphDefinition()
+	if graphKey := prof.graphKey(); graphKey != "nlb_requests" {
+		t.Fatalf("got graphKey %q, want a flat key with no \"#\"", graphKey)
+	}
+
+	for _, key := range keys {
+		found := false
+		for _, metric := range graph.Metrics {
+			if metric.Name == key {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("stat key %q has no matching bare Metrics.Name in %v", key, graph.Metrics)
+		}
+	}
+}
+
+// TestMetricProfileGroupedBuildQueriesMatchesGraphDefinition checks a
+// grouped ("#"-wildcard) profile end-to-end: every key buildQueries produces
+// matches "<graphKey with # as wildcard>.<Metrics.Name>", the lookup
+// go-mackerel-plugin's OutputValues performs for a wildcard graph.
+func TestMetricProfileGroupedBuildQueriesMatchesGraphDefinition(t *testing.T) {
+	prof := MetricProfile{
+		Namespace:      "AWS/NetworkELB",
+		GraphPrefix:    "nlb_flows",
+		GroupDimension: "TargetGroup",
+		Groups: []metricProfileGroup{
+			{DimensionValue: "targetgroup/a/1", Key: "a"},
+			{DimensionValue: "targetgroup/b/2", Key: "b"},
+		},
+		MetricNames: []string{"ActiveFlowCount"},
+		Statistics:  []string{"Sum"},
+		Period:      60,
+	}
+
+	counter := 0
+	nextID := func() string {
+		counter++
+		return "q" + string(rune('0'+counter))
+	}
+
+	_, keys := prof.buildQueries(nextID)
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2 (one per group): %v", len(keys), keys)
+	}
+
+	graphKey := prof.graphKey()
+	if graphKey != "nlb_flows.#" {
+		t.Fatalf("got graphKey %q, want \"nlb_flows.#\"", graphKey)
+	}
+
+	graph := prof.graphDefinition()
+	pattern := graphKeyPattern(graphKey, graph.Metrics[0].Name)
+	for _, key := range keys {
+		if !pattern.MatchString(key) {
+			t.Fatalf("stat key %q doesn't match %s", key, pattern)
+		}
+	}
+}
+
+// TestMetricProfileGroupedWithNoGroupsProducesNoQueries checks that a
+// grouped profile with zero actual groups (e.g. no target groups discovered
+// yet) publishes nothing, rather than one bogus ungrouped query that would
+// never match its own "#" wildcard graph.
+func TestMetricProfileGroupedWithNoGroupsProducesNoQueries(t *testing.T) {
+	prof := MetricProfile{
+		Namespace:      "AWS/NetworkELB",
+		GraphPrefix:    "nlb_flows",
+		GroupDimension: "TargetGroup",
+		MetricNames:    []string{"ActiveFlowCount"},
+		Statistics:     []string{"Sum"},
+		Period:         60,
+	}
+
+	queries, keys := prof.buildQueries(func() string { return "q0" })
+	if len(queries) != 0 || len(keys) != 0 {
+		t.Fatalf("got %d queries / %d keys, want 0/0", len(queries), len(keys))
+	}
+}
+
+// TestMetricProfileKeyAndLabelOverrides checks that MetricKeys/MetricLabels
+// override the generic "metricname_stat" key and "MetricName (Stat)" label
+// the built-in profiles rely on to keep their existing short names.
+func TestMetricProfileKeyAndLabelOverrides(t *testing.T) {
+	prof := MetricProfile{
+		MetricKeys:   map[string]string{"RequestCount_Sum": "request_count"},
+		MetricLabels: map[string]string{"RequestCount_Sum": "Requests"},
+	}
+
+	if key := prof.metricKey("RequestCount", "Sum"); key != "request_count" {
+		t.Fatalf("got metricKey %q, want \"request_count\"", key)
+	}
+	if label := prof.metricLabel("RequestCount", "Sum"); label != "Requests" {
+		t.Fatalf("got metricLabel %q, want \"Requests\"", label)
+	}
+
+	if key := prof.metricKey("OtherMetric", "Average"); key != "othermetric_average" {
+		t.Fatalf("got metricKey %q, want the generic fallback", key)
+	}
+	if label := prof.metricLabel("OtherMetric", "Average"); label != "OtherMetric (Average)" {
+		t.Fatalf("got metricLabel %q, want the generic fallback", label)
+	}
+}